@@ -0,0 +1,84 @@
+// +build windows
+
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mounter
+
+import (
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// Well-known Win32 error codes (see winerror.h) that csi-proxy surfaces in
+// the error string it returns when the SMB session backing a mount point
+// has died - the remote server became unreachable, or credentials were
+// rotated/revoked - as opposed to the mount point simply not existing.
+const (
+	errNoBadNetpath                = "ERROR_BAD_NETPATH"
+	errNoNetworkUnreachable        = "ERROR_NETWORK_UNREACHABLE"
+	errNoSessionCredentialConflict = "ERROR_SESSION_CREDENTIAL_CONFLICT"
+	errNoLogonFailure              = "ERROR_LOGON_FAILURE"
+)
+
+// IsCorruptedSMBMount reports whether err - as returned from ExistsPath or
+// IsLikelyNotMountPoint - indicates a corrupted mount: the local symlink
+// still exists but the SMB session behind it is no longer usable. This is
+// the Windows/SMB analog of mount.IsCorruptedMnt used upstream for Linux
+// bind mounts. Without this check, a corrupted mount looks identical to a
+// mount point kubelet can't yet reach, and NodeStageVolume/NodePublishVolume
+// keep retrying against it forever.
+func IsCorruptedSMBMount(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	for _, code := range []string{errNoBadNetpath, errNoNetworkUnreachable, errNoSessionCredentialConflict, errNoLogonFailure} {
+		if strings.Contains(msg, code) {
+			return true
+		}
+	}
+	return false
+}
+
+// RemountIfCorrupted is meant to be called from the node server's stage and
+// publish paths in place of surfacing checkErr directly: when checkErr
+// indicates a corrupted mount, it tears down the stale target and
+// force-removes the SmbGlobalMapping for its share, then re-runs SMBMount
+// so the caller's retry succeeds instead of looping on "file exists". Any
+// other error is returned unchanged.
+//
+// The mapping is removed via ForceRemoveSMBMapping rather than SMBUnmount:
+// a corrupted session is broken for every target bound to it, not just
+// this one, so it must come down regardless of how many other local
+// targets chunk0-1's reference counting still thinks are using it. Those
+// targets transparently re-establish the mapping the next time they're
+// accessed.
+func RemountIfCorrupted(mounter CSIProxyMounter, checkErr error, source, target, fsType string, mountOptions, sensitiveMountOptions []string) error {
+	if !IsCorruptedSMBMount(checkErr) {
+		return checkErr
+	}
+
+	klog.Warningf("corrupted SMB mount detected at %s, tearing down and remounting: %v", target, checkErr)
+	if rmErr := mounter.Rmdir(target); rmErr != nil {
+		klog.Warningf("failed to remove stale mount point %s before remount: %v", target, rmErr)
+	}
+	if forceErr := mounter.ForceRemoveSMBMapping(source); forceErr != nil {
+		klog.Warningf("failed to force-remove smb mapping for %s before remount: %v", source, forceErr)
+	}
+	return mounter.SMBMount(source, target, fsType, mountOptions, sensitiveMountOptions)
+}
@@ -0,0 +1,165 @@
+// +build windows
+
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mounter
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	mount "k8s.io/mount-utils"
+)
+
+func TestIsCorruptedSMBMount(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "nil error", err: nil, want: false},
+		{name: "plain not-exist error", err: errors.New("path does not exist"), want: false},
+		{name: "bad netpath", err: fmt.Errorf("rpc error: %s", errNoBadNetpath), want: true},
+		{name: "network unreachable", err: fmt.Errorf("rpc error: %s", errNoNetworkUnreachable), want: true},
+		{name: "session credential conflict", err: fmt.Errorf("rpc error: %s", errNoSessionCredentialConflict), want: true},
+		{name: "logon failure", err: fmt.Errorf("rpc error: %s", errNoLogonFailure), want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsCorruptedSMBMount(tt.err); got != tt.want {
+				t.Errorf("IsCorruptedSMBMount(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeRefCountMounter reproduces the smbMountRefs/smbMountTargets bookkeeping
+// shared by csiProxyMounterV1, csiProxyMounterV1Beta and winMounter, so
+// RemountIfCorrupted's interaction with that bookkeeping can be exercised
+// without a real csi-proxy connection. mount.Interface is embedded unset
+// since RemountIfCorrupted never calls through it.
+type fakeRefCountMounter struct {
+	mount.Interface
+
+	smbMountRefsMu  sync.Mutex
+	smbMountRefs    map[string]int
+	smbMountTargets map[string]string
+
+	removed map[string]bool
+}
+
+func newFakeRefCountMounter() *fakeRefCountMounter {
+	return &fakeRefCountMounter{
+		smbMountRefs:    make(map[string]int),
+		smbMountTargets: make(map[string]string),
+		removed:         make(map[string]bool),
+	}
+}
+
+func (m *fakeRefCountMounter) MakeDir(path string) error { return nil }
+
+func (m *fakeRefCountMounter) Rmdir(target string) error { return nil }
+
+func (m *fakeRefCountMounter) ExistsPath(path string) (bool, error) { return true, nil }
+
+func (m *fakeRefCountMounter) SMBMount(source, target, fsType string, mountOptions, sensitiveMountOptions []string) error {
+	mappingKey := getSMBMappingKey(source)
+	m.smbMountRefsMu.Lock()
+	defer m.smbMountRefsMu.Unlock()
+	if m.smbMountTargets[target] != mappingKey {
+		m.smbMountRefs[mappingKey]++
+		m.smbMountTargets[target] = mappingKey
+	}
+	delete(m.removed, mappingKey)
+	return nil
+}
+
+func (m *fakeRefCountMounter) SMBUnmount(target string) error {
+	m.smbMountRefsMu.Lock()
+	mappingKey, ok := m.smbMountTargets[target]
+	if ok {
+		delete(m.smbMountTargets, target)
+		m.smbMountRefs[mappingKey]--
+	}
+	refs := m.smbMountRefs[mappingKey]
+	if refs <= 0 {
+		delete(m.smbMountRefs, mappingKey)
+	}
+	m.smbMountRefsMu.Unlock()
+
+	if !ok || refs > 0 {
+		return nil
+	}
+	m.removed[mappingKey] = true
+	return nil
+}
+
+func (m *fakeRefCountMounter) ForceRemoveSMBMapping(source string) error {
+	m.removed[getSMBMappingKey(source)] = true
+	return nil
+}
+
+// TestRemountIfCorruptedPreservesOtherTargets checks, against the fake's copy
+// of the ref-count bookkeeping, that self-healing one target through
+// RemountIfCorrupted does not make an unrelated target's later SMBUnmount
+// think it held the last reference and tear the mapping out from under the
+// healed target. It drives the fake's ForceRemoveSMBMapping, not the real
+// mounters' implementations.
+func TestRemountIfCorruptedPreservesOtherTargets(t *testing.T) {
+	m := newFakeRefCountMounter()
+	const source = `\\server\share`
+	const target1 = `c:\var\lib\kubelet\plugins\target1`
+	const target2 = `c:\var\lib\kubelet\plugins\target2`
+	mappingKey := getSMBMappingKey(source)
+
+	if err := m.SMBMount(source, target1, "", []string{"user"}, []string{"pass"}); err != nil {
+		t.Fatalf("SMBMount target1: %v", err)
+	}
+	if err := m.SMBMount(source, target2, "", []string{"user"}, []string{"pass"}); err != nil {
+		t.Fatalf("SMBMount target2: %v", err)
+	}
+	if got := m.smbMountRefs[mappingKey]; got != 2 {
+		t.Fatalf("refs after mounting two targets = %d, want 2", got)
+	}
+
+	checkErr := fmt.Errorf("rpc error: %s", errNoBadNetpath)
+	if err := RemountIfCorrupted(m, checkErr, source, target1, "", []string{"user"}, []string{"pass"}); err != nil {
+		t.Fatalf("RemountIfCorrupted: %v", err)
+	}
+	if got := m.smbMountRefs[mappingKey]; got != 2 {
+		t.Errorf("refs after self-healing target1 = %d, want 2 (target2 must still be accounted for)", got)
+	}
+
+	if err := m.SMBUnmount(target2); err != nil {
+		t.Fatalf("SMBUnmount target2: %v", err)
+	}
+	if m.removed[mappingKey] {
+		t.Fatalf("unmounting target2 removed the shared mapping while target1 is still mounted")
+	}
+	if got := m.smbMountRefs[mappingKey]; got != 1 {
+		t.Errorf("refs after unmounting target2 = %d, want 1", got)
+	}
+
+	if err := m.SMBUnmount(target1); err != nil {
+		t.Fatalf("SMBUnmount target1: %v", err)
+	}
+	if !m.removed[mappingKey] {
+		t.Errorf("unmounting the last remaining target did not remove the shared mapping")
+	}
+}
@@ -0,0 +1,412 @@
+// +build windows
+
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mounter
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	filepath "path/filepath"
+	"strings"
+	"sync"
+
+	fsv1beta1 "github.com/kubernetes-csi/csi-proxy/client/api/filesystem/v1beta1"
+	fsclientv1beta1 "github.com/kubernetes-csi/csi-proxy/client/groups/filesystem/v1beta1"
+
+	smbv1beta1 "github.com/kubernetes-csi/csi-proxy/client/api/smb/v1beta1"
+	smbclientv1beta1 "github.com/kubernetes-csi/csi-proxy/client/groups/smb/v1beta1"
+
+	"k8s.io/klog/v2"
+	mount "k8s.io/mount-utils"
+)
+
+var _ CSIProxyMounter = &csiProxyMounterV1Beta{}
+
+// csiProxyMounterV1Beta talks to csi-proxy's v1beta1 filesystem and smb API
+// groups, for nodes that still run an older csi-proxy that hasn't been
+// upgraded to expose the v1 groups yet.
+type csiProxyMounterV1Beta struct {
+	// clientMu guards FsClient/SMBClient below: reconnect() replaces both
+	// clients after a csi-proxy restart while callProxy's RPCs may be
+	// in-flight for other volumes on the same mounter instance (kubelet can
+	// call NodeStageVolume/NodePublishVolume/NodeUnstageVolume concurrently).
+	clientMu  sync.RWMutex
+	FsClient  *fsclientv1beta1.Client
+	SMBClient *smbclientv1beta1.Client
+
+	// smbMountRefsMu guards smbMountRefs and smbMountTargets below.
+	smbMountRefsMu sync.Mutex
+	// smbMountRefs counts, per normalized "\\server\share" remote path, how
+	// many local targets are currently bind-mounted from it. Several pods
+	// may mount the same remote share, so the global mapping is only
+	// removed once the count drops to zero.
+	smbMountRefs map[string]int
+	// smbMountTargets records which remote path each local target was
+	// mounted from, so SMBUnmount can find the right counter to decrement.
+	smbMountTargets map[string]string
+}
+
+// fs returns the current FsClient, guarded against a concurrent reconnect().
+func (mounter *csiProxyMounterV1Beta) fs() *fsclientv1beta1.Client {
+	mounter.clientMu.RLock()
+	defer mounter.clientMu.RUnlock()
+	return mounter.FsClient
+}
+
+// smb returns the current SMBClient, guarded against a concurrent reconnect().
+func (mounter *csiProxyMounterV1Beta) smb() *smbclientv1beta1.Client {
+	mounter.clientMu.RLock()
+	defer mounter.clientMu.RUnlock()
+	return mounter.SMBClient
+}
+
+// reconnect re-dials csi-proxy's filesystem and smb named pipes, replacing
+// FsClient/SMBClient with freshly connected clients.
+func (mounter *csiProxyMounterV1Beta) reconnect() error {
+	fsClient, err := fsclientv1beta1.NewClient()
+	if err != nil {
+		return err
+	}
+	smbClient, err := smbclientv1beta1.NewClient()
+	if err != nil {
+		return err
+	}
+	mounter.clientMu.Lock()
+	mounter.FsClient = fsClient
+	mounter.SMBClient = smbClient
+	mounter.clientMu.Unlock()
+	return nil
+}
+
+// callProxy runs fn and, if fn fails because the csi-proxy named pipe
+// connection has gone away (e.g. csi-proxy restarted), reconnects and
+// retries fn once rather than returning a permanent error for the
+// remaining lifetime of the pod.
+func (mounter *csiProxyMounterV1Beta) callProxy(fn func() error) error {
+	err := fn()
+	if err == nil || !isPipeClosedErr(err) {
+		return err
+	}
+	klog.Warningf("csi-proxy connection appears closed, reconnecting: %v", err)
+	if reErr := mounter.reconnect(); reErr != nil {
+		klog.Warningf("failed to reconnect to csi-proxy: %v", reErr)
+		return err
+	}
+	return fn()
+}
+
+func (mounter *csiProxyMounterV1Beta) SMBMount(source, target, fsType string, mountOptions, sensitiveMountOptions []string) error {
+	klog.V(4).Infof("SMBMount: remote path: %s. local path: %s", source, target)
+
+	if len(mountOptions) == 0 || len(sensitiveMountOptions) == 0 {
+		return fmt.Errorf("empty mountOptions(len: %d) or sensitiveMountOptions(len: %d) is not allowed", len(mountOptions), len(sensitiveMountOptions))
+	}
+
+	parentDir := filepath.Dir(target)
+	parentExists, err := mounter.ExistsPath(parentDir)
+	if err != nil {
+		return fmt.Errorf("parent dir: %s exist check failed with err: %v", parentDir, err)
+	}
+
+	if !parentExists {
+		klog.Infof("Parent directory %s does not exists. Creating the directory", parentDir)
+		if err := mounter.MakeDir(parentDir); err != nil {
+			return fmt.Errorf("create of parent dir: %s dailed with error: %v", parentDir, err)
+		}
+	}
+
+	parts := strings.FieldsFunc(source, Split)
+	if len(parts) > 0 && strings.HasSuffix(parts[0], "svc.cluster.local") {
+		// replace hostname with IP in the source
+		domainName := parts[0]
+		ip, err := net.ResolveIPAddr("ip4", domainName)
+		if err != nil {
+			klog.Warningf("could not resolve name to IPv4 address for host %s, failed with error: %v", domainName, err)
+		} else {
+			klog.V(2).Infof("resolve the name of host %s to IPv4 address: %s", domainName, ip.String())
+			source = strings.Replace(source, domainName, ip.String(), 1)
+		}
+	}
+
+	source = strings.Replace(source, "/", "\\", -1)
+	smbMountRequest := &smbv1beta1.NewSmbGlobalMappingRequest{
+		LocalPath:  normalizeWindowsPath(target),
+		RemotePath: source,
+		Username:   mountOptions[0],
+		Password:   sensitiveMountOptions[0],
+	}
+	if err := mounter.callProxy(func() error {
+		_, err := mounter.smb().NewSmbGlobalMapping(context.Background(), smbMountRequest)
+		return err
+	}); err != nil {
+		return fmt.Errorf("smb mapping failed with error: %v", err)
+	}
+
+	mappingKey := getSMBMappingKey(source)
+	mounter.smbMountRefsMu.Lock()
+	// Only take a new reference if target isn't already counted against
+	// mappingKey - otherwise a remount of an already-tracked target (e.g.
+	// RemountIfCorrupted self-healing target after a ForceRemoveSMBMapping)
+	// would inflate the count and delay removal past every real unmount.
+	if mounter.smbMountTargets[target] != mappingKey {
+		mounter.smbMountRefs[mappingKey]++
+		mounter.smbMountTargets[target] = mappingKey
+	}
+	mounter.smbMountRefsMu.Unlock()
+
+	return nil
+}
+
+// SMBUnmount removes the local target directory and, once every target
+// referencing the remote share has been unmounted, removes the underlying
+// SmbGlobalMapping so stale "\\server\share" mappings don't accumulate on
+// the node until reboot.
+func (mounter *csiProxyMounterV1Beta) SMBUnmount(target string) error {
+	klog.V(4).Infof("SMBUnmount: local path: %s", target)
+	if err := mounter.Rmdir(target); err != nil {
+		return err
+	}
+
+	mounter.smbMountRefsMu.Lock()
+	mappingKey, ok := mounter.smbMountTargets[target]
+	if ok {
+		delete(mounter.smbMountTargets, target)
+		mounter.smbMountRefs[mappingKey]--
+	}
+	refs := mounter.smbMountRefs[mappingKey]
+	if refs <= 0 {
+		delete(mounter.smbMountRefs, mappingKey)
+	}
+	mounter.smbMountRefsMu.Unlock()
+
+	if !ok || refs > 0 || !RemoveSMBMappingDuringUnmount {
+		return nil
+	}
+
+	klog.V(4).Infof("SMBUnmount: last reference to %s released, removing SmbGlobalMapping", mappingKey)
+	removeSmbMappingRequest := &smbv1beta1.RemoveSmbGlobalMappingRequest{
+		RemotePath: mappingKey,
+	}
+	if err := mounter.callProxy(func() error {
+		_, err := mounter.smb().RemoveSmbGlobalMapping(context.Background(), removeSmbMappingRequest)
+		return err
+	}); err != nil {
+		return fmt.Errorf("remove smb mapping %s failed with error: %v", mappingKey, err)
+	}
+	return nil
+}
+
+// ForceRemoveSMBMapping removes the SmbGlobalMapping for source's share
+// regardless of the current reference count. It's used to self-heal a
+// corrupted mount (see chunk0-3's RemountIfCorrupted), which always follows
+// this up with a SMBMount for the target it's healing - so the ref-count
+// bookkeeping in smbMountRefs/smbMountTargets is left untouched here: every
+// target that was already sharing the mapping, including the one being
+// healed, is still expected to have it, and SMBMount's re-mount of the
+// healed target is a no-op against a count that was never decremented.
+// Deleting the count here would make an unrelated target's later SMBUnmount
+// think it held the last reference and tear the mapping out from under the
+// target that was just healed.
+func (mounter *csiProxyMounterV1Beta) ForceRemoveSMBMapping(source string) error {
+	mappingKey := getSMBMappingKey(source)
+
+	removeSmbMappingRequest := &smbv1beta1.RemoveSmbGlobalMappingRequest{
+		RemotePath: mappingKey,
+	}
+	if err := mounter.callProxy(func() error {
+		_, err := mounter.smb().RemoveSmbGlobalMapping(context.Background(), removeSmbMappingRequest)
+		return err
+	}); err != nil {
+		return fmt.Errorf("force remove smb mapping %s failed with error: %v", mappingKey, err)
+	}
+	return nil
+}
+
+// Mount just creates a soft link at target pointing to source.
+func (mounter *csiProxyMounterV1Beta) Mount(source string, target string, fstype string, options []string) error {
+	klog.V(4).Infof("Mount: old name: %s. new name: %s", source, target)
+	// Mount is called after the format is done.
+	// TODO: Confirm that fstype is empty.
+	linkRequest := &fsv1beta1.LinkPathRequest{
+		SourcePath: normalizeWindowsPath(source),
+		TargetPath: normalizeWindowsPath(target),
+	}
+	return mounter.callProxy(func() error {
+		_, err := mounter.fs().LinkPath(context.Background(), linkRequest)
+		return err
+	})
+}
+
+// Rmdir - delete the given directory
+func (mounter *csiProxyMounterV1Beta) Rmdir(path string) error {
+	klog.V(4).Infof("Remove directory: %s", path)
+	rmdirRequest := &fsv1beta1.RmdirRequest{
+		Path:    normalizeWindowsPath(path),
+		Context: fsv1beta1.PathContext_POD,
+		Force:   true,
+	}
+	return mounter.callProxy(func() error {
+		_, err := mounter.fs().Rmdir(context.Background(), rmdirRequest)
+		return err
+	})
+}
+
+// Unmount - Removes the directory - equivalent to unmount on Linux.
+func (mounter *csiProxyMounterV1Beta) Unmount(target string) error {
+	klog.V(4).Infof("Unmount: %s", target)
+	return mounter.Rmdir(target)
+}
+
+func (mounter *csiProxyMounterV1Beta) List() ([]mount.MountPoint, error) {
+	return []mount.MountPoint{}, fmt.Errorf("List not implemented for csiProxyMounterV1Beta")
+}
+
+func (mounter *csiProxyMounterV1Beta) IsMountPointMatch(mp mount.MountPoint, dir string) bool {
+	return mp.Path == dir
+}
+
+// IsLikelyMountPoint - If the directory does not exists, the function will return os.ErrNotExist error.
+//   If the path exists, call to CSI proxy will check if its a link, if its a link then existence of target
+//   path is checked.
+func (mounter *csiProxyMounterV1Beta) IsLikelyNotMountPoint(path string) (bool, error) {
+	klog.V(4).Infof("IsLikelyNotMountPoint: %s", path)
+	isExists, err := mounter.ExistsPath(path)
+	if err != nil {
+		return false, err
+	}
+	if !isExists {
+		return true, os.ErrNotExist
+	}
+
+	var response *fsv1beta1.IsMountPointResponse
+	err = mounter.callProxy(func() error {
+		var rpcErr error
+		response, rpcErr = mounter.fs().IsMountPoint(context.Background(),
+			&fsv1beta1.IsMountPointRequest{
+				Path: normalizeWindowsPath(path),
+			})
+		return rpcErr
+	})
+	if err != nil {
+		return false, err
+	}
+	return !response.IsMountPoint, nil
+}
+
+func (mounter *csiProxyMounterV1Beta) PathIsDevice(pathname string) (bool, error) {
+	return false, fmt.Errorf("PathIsDevice not implemented for csiProxyMounterV1Beta")
+}
+
+func (mounter *csiProxyMounterV1Beta) DeviceOpened(pathname string) (bool, error) {
+	return false, fmt.Errorf("DeviceOpened not implemented for csiProxyMounterV1Beta")
+}
+
+func (mounter *csiProxyMounterV1Beta) GetDeviceNameFromMount(mountPath, pluginMountDir string) (string, error) {
+	return "", fmt.Errorf("GetDeviceNameFromMount not implemented for csiProxyMounterV1Beta")
+}
+
+func (mounter *csiProxyMounterV1Beta) MakeRShared(path string) error {
+	return fmt.Errorf("MakeRShared not implemented for csiProxyMounterV1Beta")
+}
+
+func (mounter *csiProxyMounterV1Beta) MakeFile(pathname string) error {
+	return fmt.Errorf("MakeFile not implemented for csiProxyMounterV1Beta")
+}
+
+// MakeDir - Creates a directory. The CSI proxy takes in context information.
+// Currently the make dir is only used from the staging code path, hence we call it
+// with Plugin context..
+func (mounter *csiProxyMounterV1Beta) MakeDir(path string) error {
+	klog.V(4).Infof("Make directory: %s", path)
+	mkdirReq := &fsv1beta1.MkdirRequest{
+		Path:    normalizeWindowsPath(path),
+		Context: fsv1beta1.PathContext_PLUGIN,
+	}
+	return mounter.callProxy(func() error {
+		_, err := mounter.fs().Mkdir(context.Background(), mkdirReq)
+		return err
+	})
+}
+
+// ExistsPath - Checks if a path exists. Unlike util ExistsPath, this call does not perform follow link.
+func (mounter *csiProxyMounterV1Beta) ExistsPath(path string) (bool, error) {
+	klog.V(4).Infof("Exists path: %s", path)
+	var isExistsResponse *fsv1beta1.PathExistsResponse
+	err := mounter.callProxy(func() error {
+		var rpcErr error
+		isExistsResponse, rpcErr = mounter.fs().PathExists(context.Background(),
+			&fsv1beta1.PathExistsRequest{
+				Path: normalizeWindowsPath(path),
+			})
+		return rpcErr
+	})
+	if err != nil {
+		return false, err
+	}
+	return isExistsResponse.Exists, err
+}
+
+func (mounter *csiProxyMounterV1Beta) EvalHostSymlinks(pathname string) (string, error) {
+	return "", fmt.Errorf("EvalHostSymlinks not implemented for csiProxyMounterV1Beta")
+}
+
+func (mounter *csiProxyMounterV1Beta) GetMountRefs(pathname string) ([]string, error) {
+	return []string{}, fmt.Errorf("GetMountRefs not implemented for csiProxyMounterV1Beta")
+}
+
+func (mounter *csiProxyMounterV1Beta) GetFSGroup(pathname string) (int64, error) {
+	return -1, fmt.Errorf("GetFSGroup not implemented for csiProxyMounterV1Beta")
+}
+
+func (mounter *csiProxyMounterV1Beta) GetSELinuxSupport(pathname string) (bool, error) {
+	return false, fmt.Errorf("GetSELinuxSupport not implemented for csiProxyMounterV1Beta")
+}
+
+func (mounter *csiProxyMounterV1Beta) GetMode(pathname string) (os.FileMode, error) {
+	return 0, fmt.Errorf("GetMode not implemented for csiProxyMounterV1Beta")
+}
+
+func (mounter *csiProxyMounterV1Beta) MountSensitive(source string, target string, fstype string, options []string, sensitiveOptions []string) error {
+	return fmt.Errorf("MountSensitive not implemented for csiProxyMounterV1Beta")
+}
+
+func (mounter *csiProxyMounterV1Beta) MountSensitiveWithoutSystemd(source string, target string, fstype string, options []string, sensitiveOptions []string) error {
+	return fmt.Errorf("MountSensitiveWithoutSystemd not implemented for csiProxyMounterV1Beta")
+}
+
+// NewCSIProxyMounterV1Beta - creates a new CSI Proxy mounter struct which encompassed all the
+// v1beta1 clients to the CSI proxy - filesystem and smb clients.
+func NewCSIProxyMounterV1Beta() (*csiProxyMounterV1Beta, error) {
+	fsClient, err := fsclientv1beta1.NewClient()
+	if err != nil {
+		return nil, err
+	}
+	smbClient, err := smbclientv1beta1.NewClient()
+	if err != nil {
+		return nil, err
+	}
+
+	return &csiProxyMounterV1Beta{
+		FsClient:        fsClient,
+		SMBClient:       smbClient,
+		smbMountRefs:    make(map[string]int),
+		smbMountTargets: make(map[string]string),
+	}, nil
+}
@@ -19,29 +19,41 @@ limitations under the License.
 package mounter
 
 import (
-	"context"
-	"fmt"
-	"net"
-	"os"
-	filepath "path/filepath"
 	"strings"
 
-	fs "github.com/kubernetes-csi/csi-proxy/client/api/filesystem/v1"
-	fsclient "github.com/kubernetes-csi/csi-proxy/client/groups/filesystem/v1"
-
-	smb "github.com/kubernetes-csi/csi-proxy/client/api/smb/v1"
-	smbclient "github.com/kubernetes-csi/csi-proxy/client/groups/smb/v1"
-
 	"k8s.io/klog/v2"
 	mount "k8s.io/mount-utils"
 	utilexec "k8s.io/utils/exec"
 )
 
-var _ mount.Interface = &CSIProxyMounter{}
-
-type CSIProxyMounter struct {
-	FsClient  *fsclient.Client
-	SMBClient *smbclient.Client
+// RemoveSMBMappingDuringUnmount controls whether SMBUnmount tears down the
+// underlying SmbGlobalMapping once the last local target referencing it has
+// been unmounted. It defaults to true so stale mappings don't accumulate on
+// the node until reboot. Nothing in this tree currently sets it to false:
+// there's no driver/main package here to register a
+// --remove-smb-mapping-during-unmount flag (or any flag) against, so
+// operators can't opt out short of recompiling with this var changed.
+var RemoveSMBMappingDuringUnmount = true
+
+// CSIProxyMounter is implemented by the concrete mounters in this package:
+// the csi-proxy backed ones and winMounter, which bypasses csi-proxy. It embeds mount.Interface so a CSIProxyMounter can be
+// used anywhere a plain mount.Interface is expected, while also exposing
+// the SMB-specific calls the node server needs. Keeping this as an
+// interface - rather than a single concrete struct - lets us support
+// multiple csi-proxy API versions side by side and pick one at runtime in
+// NewSafeMounter.
+type CSIProxyMounter interface {
+	mount.Interface
+	SMBMount(source, target, fsType string, mountOptions, sensitiveMountOptions []string) error
+	SMBUnmount(target string) error
+	MakeDir(path string) error
+	Rmdir(path string) error
+	ExistsPath(path string) (bool, error)
+	// ForceRemoveSMBMapping removes the SmbGlobalMapping for source's share
+	// regardless of the current reference count. Used by RemountIfCorrupted
+	// to self-heal a corrupted mount even when other local targets still
+	// reference the same share.
+	ForceRemoveSMBMapping(source string) error
 }
 
 func normalizeWindowsPath(path string) string {
@@ -52,237 +64,79 @@ func normalizeWindowsPath(path string) string {
 	return normalizedPath
 }
 
-func (mounter *CSIProxyMounter) SMBMount(source, target, fsType string, mountOptions, sensitiveMountOptions []string) error {
-	klog.V(4).Infof("SMBMount: remote path: %s. local path: %s", source, target)
-
-	if len(mountOptions) == 0 || len(sensitiveMountOptions) == 0 {
-		return fmt.Errorf("empty mountOptions(len: %d) or sensitiveMountOptions(len: %d) is not allowed", len(mountOptions), len(sensitiveMountOptions))
-	}
-
-	parentDir := filepath.Dir(target)
-	parentExists, err := mounter.ExistsPath(parentDir)
-	if err != nil {
-		return fmt.Errorf("parent dir: %s exist check failed with err: %v", parentDir, err)
-	}
-
-	if !parentExists {
-		klog.Infof("Parent directory %s does not exists. Creating the directory", parentDir)
-		if err := mounter.MakeDir(parentDir); err != nil {
-			return fmt.Errorf("create of parent dir: %s dailed with error: %v", parentDir, err)
-		}
-	}
-
-	parts := strings.FieldsFunc(source, Split)
-	if len(parts) > 0 && strings.HasSuffix(parts[0], "svc.cluster.local") {
-		// replace hostname with IP in the source
-		domainName := parts[0]
-		ip, err := net.ResolveIPAddr("ip4", domainName)
-		if err != nil {
-			klog.Warningf("could not resolve name to IPv4 address for host %s, failed with error: %v", domainName, err)
-		} else {
-			klog.V(2).Infof("resolve the name of host %s to IPv4 address: %s", domainName, ip.String())
-			source = strings.Replace(source, domainName, ip.String(), 1)
-		}
-	}
-
-	source = strings.Replace(source, "/", "\\", -1)
-	smbMountRequest := &smb.NewSmbGlobalMappingRequest{
-		LocalPath:  normalizeWindowsPath(target),
-		RemotePath: source,
-		Username:   mountOptions[0],
-		Password:   sensitiveMountOptions[0],
-	}
-	if _, err := mounter.SMBClient.NewSmbGlobalMapping(context.Background(), smbMountRequest); err != nil {
-		return fmt.Errorf("smb mapping failed with error: %v", err)
-	}
-	return nil
-}
-
-func (mounter *CSIProxyMounter) SMBUnmount(target string) error {
-	klog.V(4).Infof("SMBUnmount: local path: %s", target)
-	// TODO: We need to remove the SMB mapping. The change to remove the
-	// directory brings the CSI code in parity with the in-tree.
-	return mounter.Rmdir(target)
-}
-
-// Mount just creates a soft link at target pointing to source.
-func (mounter *CSIProxyMounter) Mount(source string, target string, fstype string, options []string) error {
-	klog.V(4).Infof("Mount: old name: %s. new name: %s", source, target)
-	// Mount is called after the format is done.
-	// TODO: Confirm that fstype is empty.
-	linkRequest := &fs.LinkPathRequest{
-		SourcePath: normalizeWindowsPath(source),
-		TargetPath: normalizeWindowsPath(target),
-	}
-	_, err := mounter.FsClient.LinkPath(context.Background(), linkRequest)
-	if err != nil {
-		return err
+// getSMBMappingKey returns the "\\server\share" portion of a remote SMB
+// path, dropping any sub-path, since a single SmbGlobalMapping covers the
+// whole share regardless of which sub-directory a target is bound to.
+// Forward slashes are treated as backslashes, as SMBMount does.
+func getSMBMappingKey(remotePath string) string {
+	remotePath = strings.Replace(remotePath, "/", `\`, -1)
+	trimmed := strings.TrimPrefix(remotePath, `\\`)
+	parts := strings.SplitN(trimmed, `\`, 3)
+	if len(parts) < 2 {
+		return `\\` + trimmed
 	}
-	return nil
+	return `\\` + parts[0] + `\` + parts[1]
 }
 
 func Split(r rune) bool {
 	return r == ' ' || r == '/'
 }
 
-// Rmdir - delete the given directory
-// TODO: Call separate rmdir for pod context and plugin context. v1alpha1 for CSI
-//       proxy does a relaxed check for prefix as c:\var\lib\kubelet, so we can do
-//       rmdir with either pod or plugin context.
-func (mounter *CSIProxyMounter) Rmdir(path string) error {
-	klog.V(4).Infof("Remove directory: %s", path)
-	rmdirRequest := &fs.RmdirRequest{
-		Path:    normalizeWindowsPath(path),
-		Context: fs.PathContext_POD,
-		Force:   true,
-	}
-	_, err := mounter.FsClient.Rmdir(context.Background(), rmdirRequest)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-// Unmount - Removes the directory - equivalent to unmount on Linux.
-func (mounter *CSIProxyMounter) Unmount(target string) error {
-	klog.V(4).Infof("Unmount: %s", target)
-	return mounter.Rmdir(target)
-}
-
-func (mounter *CSIProxyMounter) List() ([]mount.MountPoint, error) {
-	return []mount.MountPoint{}, fmt.Errorf("List not implemented for CSIProxyMounter")
-}
-
-func (mounter *CSIProxyMounter) IsMountPointMatch(mp mount.MountPoint, dir string) bool {
-	return mp.Path == dir
-}
-
-// IsLikelyMountPoint - If the directory does not exists, the function will return os.ErrNotExist error.
-//   If the path exists, call to CSI proxy will check if its a link, if its a link then existence of target
-//   path is checked.
-func (mounter *CSIProxyMounter) IsLikelyNotMountPoint(path string) (bool, error) {
-	klog.V(4).Infof("IsLikelyNotMountPoint: %s", path)
-	isExists, err := mounter.ExistsPath(path)
-	if err != nil {
-		return false, err
-	}
-	if !isExists {
-		return true, os.ErrNotExist
-	}
-
-	response, err := mounter.FsClient.IsMountPoint(context.Background(),
-		&fs.IsMountPointRequest{
-			Path: normalizeWindowsPath(path),
-		})
-	if err != nil {
-		return false, err
-	}
-	return !response.IsMountPoint, nil
-}
-
-func (mounter *CSIProxyMounter) PathIsDevice(pathname string) (bool, error) {
-	return false, fmt.Errorf("PathIsDevice not implemented for CSIProxyMounter")
-}
-
-func (mounter *CSIProxyMounter) DeviceOpened(pathname string) (bool, error) {
-	return false, fmt.Errorf("DeviceOpened not implemented for CSIProxyMounter")
-}
-
-func (mounter *CSIProxyMounter) GetDeviceNameFromMount(mountPath, pluginMountDir string) (string, error) {
-	return "", fmt.Errorf("GetDeviceNameFromMount not implemented for CSIProxyMounter")
-}
-
-func (mounter *CSIProxyMounter) MakeRShared(path string) error {
-	return fmt.Errorf("MakeRShared not implemented for CSIProxyMounter")
-}
-
-func (mounter *CSIProxyMounter) MakeFile(pathname string) error {
-	return fmt.Errorf("MakeFile not implemented for CSIProxyMounter")
-}
-
-// MakeDir - Creates a directory. The CSI proxy takes in context information.
-// Currently the make dir is only used from the staging code path, hence we call it
-// with Plugin context..
-func (mounter *CSIProxyMounter) MakeDir(path string) error {
-	klog.V(4).Infof("Make directory: %s", path)
-	mkdirReq := &fs.MkdirRequest{
-		Path:    normalizeWindowsPath(path),
-		Context: fs.PathContext_PLUGIN,
-	}
-	_, err := mounter.FsClient.Mkdir(context.Background(), mkdirReq)
-	if err != nil {
-		return err
+// isPipeClosedErr reports whether err looks like it came from a csi-proxy
+// named pipe connection that has gone away (e.g. csi-proxy restarted). It's
+// used to decide whether to transparently re-dial csi-proxy and retry a
+// call once, instead of returning a permanent error for the rest of the
+// pod's lifetime.
+func isPipeClosedErr(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "the pipe has been ended") ||
+		strings.Contains(msg, "use of closed network connection") ||
+		strings.Contains(msg, "transport is closing") ||
+		strings.Contains(msg, "error reading from server")
+}
+
+// NewSafeMounter creates a new mount.SafeFormatAndMount backed by a
+// CSIProxyMounter. When EnableWindowsHostProcess is set it returns a
+// winMounter and does not contact csi-proxy. Otherwise it first creates
+// csi-proxy's v1 API group clients; if creating them fails, it falls back
+// to the v1beta clients for nodes that haven't upgraded csi-proxy yet.
+// No RPC is issued here, so a v1 server that answers later RPCs with
+// Unimplemented does not cause a fallback to v1beta.
+//
+// This dials csi-proxy's named pipes, so it should be called once at
+// driver startup and the returned *mount.SafeFormatAndMount shared across
+// the node server, rather than re-created on every NodeStageVolume/
+// NodePublishVolume call. The underlying CSIProxyMounter reconnects on its
+// own if the csi-proxy connection drops in the meantime.
+func NewSafeMounter() (*mount.SafeFormatAndMount, error) {
+	if EnableWindowsHostProcess {
+		klog.V(2).Infof("using winMounter, %s", "HostProcess container mode")
+		return &mount.SafeFormatAndMount{
+			Interface: NewWinMounter(),
+			Exec:      utilexec.New(),
+		}, nil
 	}
 
-	return nil
-}
-
-// ExistsPath - Checks if a path exists. Unlike util ExistsPath, this call does not perform follow link.
-func (mounter *CSIProxyMounter) ExistsPath(path string) (bool, error) {
-	klog.V(4).Infof("Exists path: %s", path)
-	isExistsResponse, err := mounter.FsClient.PathExists(context.Background(),
-		&fs.PathExistsRequest{
-			Path: normalizeWindowsPath(path),
-		})
-	if err != nil {
-		return false, err
+	csiProxyMounter, err := NewCSIProxyMounterV1()
+	if err == nil {
+		klog.V(2).Infof("using CSIProxyMounterV1, %s", "sanity check passed")
+		return &mount.SafeFormatAndMount{
+			Interface: csiProxyMounter,
+			Exec:      utilexec.New(),
+		}, nil
 	}
-	return isExistsResponse.Exists, err
-}
+	klog.V(2).Infof("failed to connect to csi-proxy v1 with error: %v, falling back to v1beta", err)
 
-func (mounter *CSIProxyMounter) EvalHostSymlinks(pathname string) (string, error) {
-	return "", fmt.Errorf("EvalHostSymlinks not implemented for CSIProxyMounter")
-}
-
-func (mounter *CSIProxyMounter) GetMountRefs(pathname string) ([]string, error) {
-	return []string{}, fmt.Errorf("GetMountRefs not implemented for CSIProxyMounter")
-}
-
-func (mounter *CSIProxyMounter) GetFSGroup(pathname string) (int64, error) {
-	return -1, fmt.Errorf("GetFSGroup not implemented for CSIProxyMounter")
-}
-
-func (mounter *CSIProxyMounter) GetSELinuxSupport(pathname string) (bool, error) {
-	return false, fmt.Errorf("GetSELinuxSupport not implemented for CSIProxyMounter")
-}
-
-func (mounter *CSIProxyMounter) GetMode(pathname string) (os.FileMode, error) {
-	return 0, fmt.Errorf("GetMode not implemented for CSIProxyMounter")
-}
-
-func (mounter *CSIProxyMounter) MountSensitive(source string, target string, fstype string, options []string, sensitiveOptions []string) error {
-	return fmt.Errorf("MountSensitive not implemented for CSIProxyMounter")
-}
-
-func (mounter *CSIProxyMounter) MountSensitiveWithoutSystemd(source string, target string, fstype string, options []string, sensitiveOptions []string) error {
-	return fmt.Errorf("MountSensitiveWithoutSystemd not implemented for CSIProxyMounter")
-}
-
-// NewCSIProxyMounter - creates a new CSI Proxy mounter struct which encompassed all the
-// clients to the CSI proxy - filesystem, disk and volume clients.
-func NewCSIProxyMounter() (*CSIProxyMounter, error) {
-	fsClient, err := fsclient.NewClient()
-	if err != nil {
-		return nil, err
-	}
-	smbClient, err := smbclient.NewClient()
-	if err != nil {
-		return nil, err
-	}
-
-	return &CSIProxyMounter{
-		FsClient:  fsClient,
-		SMBClient: smbClient,
-	}, nil
-}
-
-func NewSafeMounter() (*mount.SafeFormatAndMount, error) {
-	csiProxyMounter, err := NewCSIProxyMounter()
+	csiProxyMounterV1Beta, err := NewCSIProxyMounterV1Beta()
 	if err != nil {
 		return nil, err
 	}
+	klog.V(2).Infof("using CSIProxyMounterV1Beta, %s", "sanity check passed")
 	return &mount.SafeFormatAndMount{
-		Interface: csiProxyMounter,
+		Interface: csiProxyMounterV1Beta,
 		Exec:      utilexec.New(),
 	}, nil
 }
@@ -0,0 +1,65 @@
+// +build windows
+
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mounter
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestIsPipeClosedErr(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "nil error", err: nil, want: false},
+		{name: "unrelated error", err: errors.New("path does not exist"), want: false},
+		{name: "pipe ended", err: errors.New("read unix pipe: the pipe has been ended"), want: true},
+		{name: "closed network connection", err: errors.New("use of closed network connection"), want: true},
+		{name: "grpc transport closing", err: errors.New("rpc error: code = Unavailable desc = transport is closing"), want: true},
+		{name: "server read error", err: errors.New("error reading from server: EOF"), want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isPipeClosedErr(tt.err); got != tt.want {
+				t.Errorf("isPipeClosedErr(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetSMBMappingKey(t *testing.T) {
+	tests := []struct {
+		name       string
+		remotePath string
+		want       string
+	}{
+		{name: "share root", remotePath: `\\server\share`, want: `\\server\share`},
+		{name: "share with sub-path", remotePath: `\\server\share\sub\dir`, want: `\\server\share`},
+		{name: "no leading slashes", remotePath: `server\share\sub`, want: `\\server\share`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := getSMBMappingKey(tt.remotePath); got != tt.want {
+				t.Errorf("getSMBMappingKey(%q) = %q, want %q", tt.remotePath, got, tt.want)
+			}
+		})
+	}
+}
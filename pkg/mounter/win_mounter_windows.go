@@ -0,0 +1,333 @@
+// +build windows
+
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mounter
+
+import (
+	"fmt"
+	"net"
+	"os"
+	filepath "path/filepath"
+	"strings"
+	"sync"
+
+	"k8s.io/klog/v2"
+	mount "k8s.io/mount-utils"
+	utilexec "k8s.io/utils/exec"
+)
+
+// EnableWindowsHostProcess, when true, makes NewSafeMounter return a
+// winMounter instead of talking to csi-proxy. It defaults to false; nothing
+// in this tree sets it, and no command-line flag is registered for it here,
+// as with RemoveSMBMappingDuringUnmount. It only works on nodes where
+// the driver's DaemonSet runs as a HostProcess container, since the
+// underlying PowerShell cmdlets need to run privileged on the host.
+var EnableWindowsHostProcess = false
+
+var _ CSIProxyMounter = &winMounter{}
+
+// winMounter mounts SMB shares by shelling out to PowerShell directly on
+// the host, bypassing csi-proxy entirely. It exists for HostProcess
+// container deployments on newer Windows nodes, which can run privileged
+// and invoke New-SmbGlobalMapping/Remove-SmbGlobalMapping without going
+// through csi-proxy's named-pipe RPC.
+type winMounter struct {
+	Exec utilexec.Interface
+
+	// smbMountRefsMu guards smbMountRefs and smbMountTargets below. These
+	// track the same "\\server\share" reference counts as csiProxyMounterV1
+	// (see chunk0-1) so the HostProcess path tears down SmbGlobalMappings
+	// on the same schedule instead of leaking them.
+	smbMountRefsMu  sync.Mutex
+	smbMountRefs    map[string]int
+	smbMountTargets map[string]string
+}
+
+// NewWinMounter creates a new HostProcess-mode mounter.
+func NewWinMounter() *winMounter {
+	return &winMounter{
+		Exec:            utilexec.New(),
+		smbMountRefs:    make(map[string]int),
+		smbMountTargets: make(map[string]string),
+	}
+}
+
+func (mounter *winMounter) runPowershellCmd(format string, args ...interface{}) (string, error) {
+	cmdLine := fmt.Sprintf(format, args...)
+	klog.V(4).Infof("executing powershell command: %s", cmdLine)
+	out, err := mounter.Exec.Command("powershell", "-Command", cmdLine).CombinedOutput()
+	return string(out), err
+}
+
+// psQuote renders s as a double-quoted PowerShell string literal, suitable
+// for splicing into a -Command script built with fmt.Sprintf. Go's %q
+// applies Go escaping, which neither understands PowerShell's own escape
+// character (backtick) nor stops `$` from triggering variable/subexpression
+// expansion inside a double-quoted string - so untrusted input such as a
+// password could both corrupt the intended value (e.g. UNC paths) and break
+// out of the string to run arbitrary commands. psQuote backtick-escapes the
+// characters PowerShell treats specially in a double-quoted string: the
+// backtick itself, the closing quote, and `$`.
+func psQuote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '`', '"', '$':
+			b.WriteByte('`')
+		}
+		b.WriteRune(r)
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+func (mounter *winMounter) SMBMount(source, target, fsType string, mountOptions, sensitiveMountOptions []string) error {
+	klog.V(4).Infof("SMBMount: remote path: %s. local path: %s", source, target)
+
+	if len(mountOptions) == 0 || len(sensitiveMountOptions) == 0 {
+		return fmt.Errorf("empty mountOptions(len: %d) or sensitiveMountOptions(len: %d) is not allowed", len(mountOptions), len(sensitiveMountOptions))
+	}
+
+	parentDir := filepath.Dir(target)
+	parentExists, err := mounter.ExistsPath(parentDir)
+	if err != nil {
+		return fmt.Errorf("parent dir: %s exist check failed with err: %v", parentDir, err)
+	}
+	if !parentExists {
+		klog.Infof("Parent directory %s does not exists. Creating the directory", parentDir)
+		if err := mounter.MakeDir(parentDir); err != nil {
+			return fmt.Errorf("create of parent dir: %s dailed with error: %v", parentDir, err)
+		}
+	}
+
+	parts := strings.FieldsFunc(source, Split)
+	if len(parts) > 0 && strings.HasSuffix(parts[0], "svc.cluster.local") {
+		domainName := parts[0]
+		ip, err := net.ResolveIPAddr("ip4", domainName)
+		if err != nil {
+			klog.Warningf("could not resolve name to IPv4 address for host %s, failed with error: %v", domainName, err)
+		} else {
+			klog.V(2).Infof("resolve the name of host %s to IPv4 address: %s", domainName, ip.String())
+			source = strings.Replace(source, domainName, ip.String(), 1)
+		}
+	}
+	source = strings.Replace(source, "/", "\\", -1)
+	username := mountOptions[0]
+	password := sensitiveMountOptions[0]
+
+	mappingKey := getSMBMappingKey(source)
+	if out, err := mounter.runPowershellCmd(
+		`$ErrorActionPreference = "Stop"; Get-SmbGlobalMapping -RemotePath %s -ErrorAction Ignore`, psQuote(mappingKey)); err != nil || !strings.Contains(out, mappingKey) {
+		if _, err := mounter.runPowershellCmd(
+			`$ErrorActionPreference = "Stop"; $Password = ConvertTo-SecureString -String %s -AsPlainText -Force; $Credential = New-Object System.Management.Automation.PSCredential(%s, $Password); New-SmbGlobalMapping -RemotePath %s -Credential $Credential -RequirePrivacy $true`,
+			psQuote(password), psQuote(username), psQuote(mappingKey)); err != nil {
+			return fmt.Errorf("smb mapping failed with error: %v", err)
+		}
+	}
+
+	if _, err := mounter.runPowershellCmd(
+		`$ErrorActionPreference = "Stop"; New-Item -ItemType SymbolicLink -Path %s -Target %s`, psQuote(target), psQuote(source)); err != nil {
+		return fmt.Errorf("create symlink from %s to %s failed with error: %v", target, source, err)
+	}
+
+	mounter.smbMountRefsMu.Lock()
+	// Only take a new reference if target isn't already counted against
+	// mappingKey - otherwise a remount of an already-tracked target (e.g.
+	// RemountIfCorrupted self-healing target after a ForceRemoveSMBMapping)
+	// would inflate the count and delay removal past every real unmount.
+	if mounter.smbMountTargets[target] != mappingKey {
+		mounter.smbMountRefs[mappingKey]++
+		mounter.smbMountTargets[target] = mappingKey
+	}
+	mounter.smbMountRefsMu.Unlock()
+
+	return nil
+}
+
+// SMBUnmount removes the local symlink and, once every target referencing
+// the remote share has been unmounted, removes the underlying
+// SmbGlobalMapping - mirroring csiProxyMounterV1.SMBUnmount's ref counting
+// from chunk0-1 so the HostProcess path doesn't leak stale mappings either.
+func (mounter *winMounter) SMBUnmount(target string) error {
+	klog.V(4).Infof("SMBUnmount: local path: %s", target)
+	if err := mounter.Rmdir(target); err != nil {
+		return err
+	}
+
+	mounter.smbMountRefsMu.Lock()
+	mappingKey, ok := mounter.smbMountTargets[target]
+	if ok {
+		delete(mounter.smbMountTargets, target)
+		mounter.smbMountRefs[mappingKey]--
+	}
+	refs := mounter.smbMountRefs[mappingKey]
+	if refs <= 0 {
+		delete(mounter.smbMountRefs, mappingKey)
+	}
+	mounter.smbMountRefsMu.Unlock()
+
+	if !ok || refs > 0 || !RemoveSMBMappingDuringUnmount {
+		return nil
+	}
+
+	klog.V(4).Infof("SMBUnmount: last reference to %s released, removing SmbGlobalMapping", mappingKey)
+	if _, err := mounter.runPowershellCmd(
+		`$ErrorActionPreference = "Stop"; Remove-SmbGlobalMapping -RemotePath %s -Force`, psQuote(mappingKey)); err != nil {
+		return fmt.Errorf("remove smb mapping %s failed with error: %v", mappingKey, err)
+	}
+	return nil
+}
+
+// ForceRemoveSMBMapping removes the SmbGlobalMapping for source's share
+// regardless of the current reference count. It's used to self-heal a
+// corrupted mount (see chunk0-3's RemountIfCorrupted), which always follows
+// this up with a SMBMount for the target it's healing - so the ref-count
+// bookkeeping in smbMountRefs/smbMountTargets is left untouched here: every
+// target that was already sharing the mapping, including the one being
+// healed, is still expected to have it, and SMBMount's re-mount of the
+// healed target is a no-op against a count that was never decremented.
+// Deleting the count here would make an unrelated target's later SMBUnmount
+// think it held the last reference and tear the mapping out from under the
+// target that was just healed.
+func (mounter *winMounter) ForceRemoveSMBMapping(source string) error {
+	mappingKey := getSMBMappingKey(source)
+
+	if _, err := mounter.runPowershellCmd(
+		`$ErrorActionPreference = "Stop"; Remove-SmbGlobalMapping -RemotePath %s -Force`, psQuote(mappingKey)); err != nil {
+		return fmt.Errorf("force remove smb mapping %s failed with error: %v", mappingKey, err)
+	}
+	return nil
+}
+
+// Mount is not implemented for winMounter - SMBMount creates the symlink
+// directly since there's no separate csi-proxy LinkPath step to mirror.
+func (mounter *winMounter) Mount(source string, target string, fstype string, options []string) error {
+	return fmt.Errorf("Mount not implemented for winMounter")
+}
+
+// Rmdir removes the target, which may be a directory or a symlink left
+// behind by SMBMount.
+func (mounter *winMounter) Rmdir(path string) error {
+	klog.V(4).Infof("Remove directory: %s", path)
+	if _, err := mounter.runPowershellCmd(`$ErrorActionPreference = "Stop"; Remove-Item -Path %s -Force -Recurse`, psQuote(path)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Unmount - Removes the directory - equivalent to unmount on Linux.
+func (mounter *winMounter) Unmount(target string) error {
+	klog.V(4).Infof("Unmount: %s", target)
+	return mounter.Rmdir(target)
+}
+
+func (mounter *winMounter) List() ([]mount.MountPoint, error) {
+	return []mount.MountPoint{}, fmt.Errorf("List not implemented for winMounter")
+}
+
+func (mounter *winMounter) IsMountPointMatch(mp mount.MountPoint, dir string) bool {
+	return mp.Path == dir
+}
+
+// IsLikelyNotMountPoint - If the directory does not exist, returns
+// os.ErrNotExist. Otherwise checks whether the path is a symlink created
+// by SMBMount.
+func (mounter *winMounter) IsLikelyNotMountPoint(path string) (bool, error) {
+	klog.V(4).Infof("IsLikelyNotMountPoint: %s", path)
+	isExists, err := mounter.ExistsPath(path)
+	if err != nil {
+		return false, err
+	}
+	if !isExists {
+		return true, os.ErrNotExist
+	}
+
+	out, err := mounter.runPowershellCmd(`$ErrorActionPreference = "Stop"; (Get-Item -Path %s).Attributes.ToString().Contains('ReparsePoint')`, psQuote(path))
+	if err != nil {
+		return false, err
+	}
+	return !strings.Contains(strings.ToLower(out), "true"), nil
+}
+
+func (mounter *winMounter) PathIsDevice(pathname string) (bool, error) {
+	return false, fmt.Errorf("PathIsDevice not implemented for winMounter")
+}
+
+func (mounter *winMounter) DeviceOpened(pathname string) (bool, error) {
+	return false, fmt.Errorf("DeviceOpened not implemented for winMounter")
+}
+
+func (mounter *winMounter) GetDeviceNameFromMount(mountPath, pluginMountDir string) (string, error) {
+	return "", fmt.Errorf("GetDeviceNameFromMount not implemented for winMounter")
+}
+
+func (mounter *winMounter) MakeRShared(path string) error {
+	return fmt.Errorf("MakeRShared not implemented for winMounter")
+}
+
+func (mounter *winMounter) MakeFile(pathname string) error {
+	return fmt.Errorf("MakeFile not implemented for winMounter")
+}
+
+// MakeDir creates a directory on the host.
+func (mounter *winMounter) MakeDir(path string) error {
+	klog.V(4).Infof("Make directory: %s", path)
+	if _, err := mounter.runPowershellCmd(`$ErrorActionPreference = "Stop"; New-Item -ItemType Directory -Path %s -Force`, psQuote(path)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ExistsPath checks if a path exists on the host.
+func (mounter *winMounter) ExistsPath(path string) (bool, error) {
+	klog.V(4).Infof("Exists path: %s", path)
+	out, err := mounter.runPowershellCmd(`$ErrorActionPreference = "Stop"; Test-Path -Path %s`, psQuote(path))
+	if err != nil {
+		return false, err
+	}
+	return strings.Contains(strings.ToLower(out), "true"), nil
+}
+
+func (mounter *winMounter) EvalHostSymlinks(pathname string) (string, error) {
+	return "", fmt.Errorf("EvalHostSymlinks not implemented for winMounter")
+}
+
+func (mounter *winMounter) GetMountRefs(pathname string) ([]string, error) {
+	return []string{}, fmt.Errorf("GetMountRefs not implemented for winMounter")
+}
+
+func (mounter *winMounter) GetFSGroup(pathname string) (int64, error) {
+	return -1, fmt.Errorf("GetFSGroup not implemented for winMounter")
+}
+
+func (mounter *winMounter) GetSELinuxSupport(pathname string) (bool, error) {
+	return false, fmt.Errorf("GetSELinuxSupport not implemented for winMounter")
+}
+
+func (mounter *winMounter) GetMode(pathname string) (os.FileMode, error) {
+	return 0, fmt.Errorf("GetMode not implemented for winMounter")
+}
+
+func (mounter *winMounter) MountSensitive(source string, target string, fstype string, options []string, sensitiveOptions []string) error {
+	return fmt.Errorf("MountSensitive not implemented for winMounter")
+}
+
+func (mounter *winMounter) MountSensitiveWithoutSystemd(source string, target string, fstype string, options []string, sensitiveOptions []string) error {
+	return fmt.Errorf("MountSensitiveWithoutSystemd not implemented for winMounter")
+}
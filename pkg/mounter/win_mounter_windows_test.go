@@ -0,0 +1,57 @@
+// +build windows
+
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mounter
+
+import "testing"
+
+func TestPsQuote(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "UNC path is passed through unescaped",
+			in:   `\\server\share`,
+			want: `"\\server\share"`,
+		},
+		{
+			name: "embedded double quote is backtick-escaped",
+			in:   `a"b`,
+			want: "\"a`\"b\"",
+		},
+		{
+			name: "embedded backtick is backtick-escaped",
+			in:   "a`b",
+			want: "\"a``b\"",
+		},
+		{
+			name: "dollar sign is escaped so subexpressions don't execute",
+			in:   `p$(Remove-Item C:\ -Recurse -Force)wd`,
+			want: "\"p`$(Remove-Item C:\\ -Recurse -Force)wd\"",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := psQuote(tt.in); got != tt.want {
+				t.Errorf("psQuote(%q) = %s, want %s", tt.in, got, tt.want)
+			}
+		})
+	}
+}